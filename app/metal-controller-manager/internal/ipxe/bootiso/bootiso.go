@@ -0,0 +1,211 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package bootiso builds hybrid ISO/USB images that bootstrap the same
+// discovery/environment flow as the iPXE boot file handler, for hardware
+// that can't (or shouldn't) PXE boot.
+package bootiso
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// grubCfgTemplate mirrors the entries produced by the iPXE config template:
+// one menu entry per matching Environment, chainloading the same kernel
+// with the same kernel args.
+var grubCfgTemplate = template.Must(template.New("grub.cfg").Parse(`set timeout=5
+set default=0
+
+{{range $i, $entry := .Entries}}menuentry "{{$entry.Env.Name}}" {
+	insmod all_video
+	linux /env/{{$entry.Env.Name}}/vmlinuz {{range $arg := $entry.Env.KernelArgs}} {{$arg}}{{end}}
+	initrd /env/{{$entry.Env.Name}}/initramfs.xz
+}
+{{end}}`))
+
+// Entry is a single GRUB menu entry, one per Environment CRD that matched
+// the requesting server (or the discovery environment as a fallback).
+// VmlinuzPath and InitrdPath are local paths resolved by the caller
+// (staged, mirror-cached, or freshly fetched) — this package only copies
+// from them, so it doesn't need to know how they were resolved.
+type Entry struct {
+	Env         EnvironmentLike
+	VmlinuzPath string
+	InitrdPath  string
+}
+
+// EnvironmentLike is the subset of metalv1alpha1.Environment that the
+// template needs. It's expressed as an interface so this package doesn't
+// import the API types package, keeping the ISO build mechanics decoupled
+// from Kubernetes.
+type EnvironmentLike interface {
+	Name() string
+	KernelArgs() []string
+}
+
+// Config controls how a Builder assembles an image.
+type Config struct {
+	// WorkDir is a scratch directory the builder may freely create,
+	// populate, and remove. Defaults to a temp dir under os.TempDir when
+	// empty.
+	WorkDir string
+}
+
+// Builder assembles hybrid BIOS/UEFI ISO and USB images on demand.
+type Builder struct {
+	config Config
+}
+
+// NewBuilder returns a Builder for the given Config.
+func NewBuilder(config Config) *Builder {
+	return &Builder{config: config}
+}
+
+// BuildISO renders a grub.cfg for entries, stages the kernel/initrd for
+// each entry, and produces a hybrid ISO/USB image at destPath via
+// xorriso. The returned image can be booted from optical media or dd'd
+// directly to a USB stick.
+func (b *Builder) BuildISO(entries []Entry, destPath string) error {
+	root, err := b.stage(entries)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(root)
+
+	if err := buildGrubImages(root); err != nil {
+		return err
+	}
+
+	return xorrisoBuild(root, destPath)
+}
+
+// stage creates a scratch tree rooted at a temp (or configured) workdir,
+// writes grub.cfg, and copies each entry's vmlinuz/initramfs.xz into it
+// from whatever local path the caller resolved them to.
+func (b *Builder) stage(entries []Entry) (string, error) {
+	workDir := b.config.WorkDir
+	if workDir == "" {
+		var err error
+
+		workDir, err = ioutil.TempDir("", "sidero-bootiso-")
+		if err != nil {
+			return "", fmt.Errorf("creating scratch dir: %w", err)
+		}
+	}
+
+	envRoot := filepath.Join(workDir, "env")
+
+	for _, entry := range entries {
+		dst := filepath.Join(envRoot, entry.Env.Name())
+
+		if err := os.MkdirAll(dst, 0o755); err != nil {
+			return "", fmt.Errorf("creating env dir %q: %w", dst, err)
+		}
+
+		if err := copyFile(entry.VmlinuzPath, filepath.Join(dst, "vmlinuz")); err != nil {
+			return "", fmt.Errorf("staging vmlinuz for env %q: %w", entry.Env.Name(), err)
+		}
+
+		if err := copyFile(entry.InitrdPath, filepath.Join(dst, "initramfs.xz")); err != nil {
+			return "", fmt.Errorf("staging initramfs.xz for env %q: %w", entry.Env.Name(), err)
+		}
+	}
+
+	cfgDir := filepath.Join(workDir, "boot", "grub")
+
+	if err := os.MkdirAll(cfgDir, 0o755); err != nil {
+		return "", fmt.Errorf("creating grub dir: %w", err)
+	}
+
+	cfgFile, err := os.Create(filepath.Join(cfgDir, "grub.cfg"))
+	if err != nil {
+		return "", fmt.Errorf("creating grub.cfg: %w", err)
+	}
+
+	defer cfgFile.Close() //nolint:errcheck
+
+	if err := grubCfgTemplate.Execute(cfgFile, struct{ Entries []Entry }{Entries: entries}); err != nil {
+		return "", fmt.Errorf("rendering grub.cfg: %w", err)
+	}
+
+	return workDir, nil
+}
+
+// buildGrubImages produces the BIOS and UEFI standalone GRUB images that
+// chainload boot/grub/grub.cfg, using only the modules needed to boot
+// off iso9660/usb media.
+func buildGrubImages(root string) error {
+	modules := "--modules=" + strings.Join([]string{"linux", "normal", "iso9660", "biosdisk", "part_msdos", "all_video", "efi_gop", "efi_uga", "search"}, " ")
+
+	biosImg := filepath.Join(root, "boot", "grub", "i386-pc", "core.img")
+	if err := os.MkdirAll(filepath.Dir(biosImg), 0o755); err != nil {
+		return err
+	}
+
+	if err := run("grub-mkstandalone",
+		"--format=i386-pc",
+		"--output="+biosImg,
+		"--prefix=/boot/grub",
+		modules,
+	); err != nil {
+		return fmt.Errorf("building BIOS GRUB image: %w", err)
+	}
+
+	efiImg := filepath.Join(root, "EFI", "BOOT", "BOOTX64.EFI")
+	if err := os.MkdirAll(filepath.Dir(efiImg), 0o755); err != nil {
+		return err
+	}
+
+	return run("grub-mkstandalone",
+		"--format=x86_64-efi",
+		"--output="+efiImg,
+		"--prefix=/boot/grub",
+		modules,
+	)
+}
+
+// xorrisoBuild produces a hybrid ISO/USB image from root, bootable via
+// BIOS (isolinux-style El Torito over the staged GRUB core.img) and UEFI
+// (the EFI System Partition staged under EFI/BOOT).
+func xorrisoBuild(root, destPath string) error {
+	return run("xorriso", "-as", "mkisofs",
+		"-o", destPath,
+		"-r", "-J",
+		"-b", "boot/grub/i386-pc/core.img",
+		"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table",
+		"-eltorito-alt-boot",
+		"-e", "EFI/BOOT/BOOTX64.EFI",
+		"-no-emul-boot",
+		"-isohybrid-gpt-basdat",
+		root,
+	)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dst, data, 0o644)
+}
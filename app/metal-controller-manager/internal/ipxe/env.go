@@ -0,0 +1,242 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipxe
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	metalv1alpha1 "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/internal/ipxe/middleware"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/internal/ipxe/mirror"
+)
+
+// envDir is where operators pre-stage env artifacts; files here are
+// served as-is and are never eviction candidates.
+const envDir = "/var/lib/sidero/env"
+
+// mirrorCacheDir is the mirror backend's own cache root, kept separate
+// from envDir so its LRU eviction never touches operator-managed,
+// pre-staged artifacts.
+const mirrorCacheDir = envDir + "/.mirror-cache"
+
+// mirrorBackend lazy-fetches env artifacts that aren't staged locally
+// yet, caching them under mirrorCacheDir so later requests hit disk
+// directly.
+var mirrorBackend = mirror.NewBackend(mirror.Config{
+	CacheDir:   mirrorCacheDir,
+	QuotaBytes: 10 << 30, // 10GiB; operators needing more should pre-stage envs instead.
+})
+
+// envFileHandler serves /env/<env>/<file> from either the pre-staged
+// envDir or the mirror cache, falling back to the Environment CRD's
+// Spec.Mirror to lazily fetch and cache the file from an upstream
+// registry/mirror when it's present in neither.
+func envFileHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	logger := middleware.Logger(ctx)
+
+	rel := strings.TrimPrefix(r.URL.Path, "/env/")
+
+	envName, file := splitEnvPath(rel)
+	if envName == "" || file == "" {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	if localPath, ok := envFileLocalPath(envName, file); ok {
+		if strings.HasPrefix(localPath, mirrorCacheDir+"/") {
+			middleware.RecordCacheResult(true)
+		}
+
+		serveEnvFile(w, r, envName, localPath)
+
+		return
+	}
+
+	spec, digest, err := mirrorSpecFor(envName, file)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		logger.Error(err, "resolving mirror", "env", envName, "file", file)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	if digest != "" {
+		w.Header().Set("ETag", fmt.Sprintf("%q", digest))
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	// Fetch tees the download straight to w as it streams in, rather than
+	// fully landing it on disk before the client sees a byte — so a
+	// multi-hundred-MB kernel/initrd doesn't sit behind its own full
+	// fetch+hash latency. teed tells us whether that actually happened
+	// for this request, or whether we joined a concurrent fetch that
+	// teed to somebody else's connection instead.
+	cachedPath, teed, err := mirrorBackend.Fetch(spec, w)
+	if err != nil {
+		if teed {
+			// The bad bytes are already on the wire; there's no clean
+			// response left to send, so abort the connection outright
+			// rather than let the client think it got a complete file.
+			logger.Error(err, "fetching env artifact mid-stream", "env", envName, "file", file)
+
+			panic(http.ErrAbortHandler)
+		}
+
+		logger.Error(err, "fetching env artifact", "env", envName, "file", file)
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+
+	middleware.RecordCacheResult(false)
+
+	if teed {
+		if info, err := os.Stat(cachedPath); err == nil {
+			middleware.RecordEnvBytesServed(envName, info.Size())
+		}
+
+		return
+	}
+
+	serveEnvFile(w, r, envName, cachedPath)
+}
+
+// serveEnvFile serves the file at path, recording the bytes served for
+// env before handing off to http.ServeFile.
+func serveEnvFile(w http.ResponseWriter, r *http.Request, env, path string) {
+	if info, err := os.Stat(path); err == nil {
+		middleware.RecordEnvBytesServed(env, info.Size())
+	}
+
+	http.ServeFile(w, r, path)
+}
+
+// envFileLocalPath returns the local path for file under envName if it's
+// already staged or mirror-cached, without triggering a mirror fetch.
+func envFileLocalPath(envName, file string) (string, bool) {
+	if stagedPath := path.Join(envDir, envName, file); fileExists(stagedPath) {
+		return stagedPath, true
+	}
+
+	if cachePath := path.Join(mirrorCacheDir, envName, file); fileExists(cachePath) {
+		return cachePath, true
+	}
+
+	return "", false
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+
+	return err == nil
+}
+
+// resolveEnvFile resolves file for envName to a local path, checking the
+// same staged/cache precedence as envFileHandler before falling back to a
+// mirror fetch on a genuine miss. Used by the boot image handlers so an
+// Environment backed only by a lazy mirror (no pre-staged files) can
+// still produce a boot image, rather than 500ing on a missing local copy.
+func resolveEnvFile(envName, file string) (string, error) {
+	if localPath, ok := envFileLocalPath(envName, file); ok {
+		return localPath, nil
+	}
+
+	spec, _, err := mirrorSpecFor(envName, file)
+	if err != nil {
+		return "", err
+	}
+
+	return mirrorBackend.Open(spec)
+}
+
+// splitEnvPath splits "<env>/<file>" into its two components.
+func splitEnvPath(rel string) (envName, file string) {
+	parts := strings.SplitN(rel, "/", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// mirrorSpecFor builds the mirror.Spec used to fetch file for envName,
+// drawing the upstream URL and optional auth from the Environment CRD's
+// Spec.Mirror, and the digest from its Spec.Kernel/Spec.Initrd.
+func mirrorSpecFor(envName, file string) (mirror.Spec, string, error) {
+	spec := mirror.Spec{CacheKey: path.Join(envName, file)}
+
+	c, err := newAgentClient()
+	if err != nil {
+		return spec, "", fmt.Errorf("creating client: %w", err)
+	}
+
+	env := &metalv1alpha1.Environment{}
+
+	if err := c.Get(context.Background(), types.NamespacedName{Name: envName}, env); err != nil {
+		return spec, "", err
+	}
+
+	digest := digestFor(env, file)
+
+	if env.Spec.Mirror == nil {
+		return spec, digest, nil
+	}
+
+	spec.URL = strings.TrimSuffix(env.Spec.Mirror.URL, "/") + "/" + file
+	spec.Digest = digest
+
+	if env.Spec.Mirror.SecretRef == nil {
+		return spec, digest, nil
+	}
+
+	secret := &corev1.Secret{}
+
+	if err := c.Get(context.Background(), types.NamespacedName{
+		Namespace: env.Spec.Mirror.SecretRef.Namespace,
+		Name:      env.Spec.Mirror.SecretRef.Name,
+	}, secret); err != nil {
+		return spec, "", fmt.Errorf("fetching mirror credentials: %w", err)
+	}
+
+	if token := secret.Data["token"]; len(token) > 0 {
+		spec.BearerToken = string(token)
+	} else {
+		spec.BasicAuth = &mirror.BasicAuth{
+			Username: string(secret.Data["username"]),
+			Password: string(secret.Data["password"]),
+		}
+	}
+
+	return spec, digest, nil
+}
+
+// digestFor returns the declared sha512 digest for file ("vmlinuz" or
+// "initramfs.xz"), or "" if none is declared on the Environment.
+func digestFor(env *metalv1alpha1.Environment, file string) string {
+	switch file {
+	case "vmlinuz":
+		return env.Spec.Kernel.SHA512
+	case "initramfs.xz":
+		return env.Spec.Initrd.SHA512
+	default:
+		return ""
+	}
+}
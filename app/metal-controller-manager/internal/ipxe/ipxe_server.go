@@ -7,14 +7,14 @@ package ipxe
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
-	"net"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"strings"
 	"text/template"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -23,13 +23,20 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	metalv1alpha1 "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/internal/ipxe/bootiso"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/internal/ipxe/middleware"
 	"github.com/talos-systems/sidero/app/metal-controller-manager/internal/server"
 	agentclient "github.com/talos-systems/sidero/app/metal-controller-manager/pkg/client"
 )
 
-const bootFile = `#!ipxe
-chain ipxe?uuid=${uuid}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}
-`
+// isoBuilder builds the hybrid ISO/USB images served from /boot.iso and
+// /boot.img. It's package-level like apiEndpoint since ServeIPXE wires up
+// a single instance per process.
+var isoBuilder = bootiso.NewBuilder(bootiso.Config{})
+
+var bootFileTemplate = template.Must(template.New("boot.ipxe").Parse(`#!ipxe
+chain {{.Scheme}}ipxe?uuid=${uuid}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}
+`))
 
 var ipxeTemplate = template.Must(template.New("iPXE config").Parse(`#!ipxe
 kernel /env/{{ .Env.Name }}/vmlinuz {{range $arg := .Env.Spec.Kernel.Args}} {{$arg}}{{end}}
@@ -39,11 +46,57 @@ boot
 
 var apiEndpoint string
 
-func bootFileHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, bootFile)
+// bootFileHandler chains into /ipxe, using an absolute https:// URL when
+// the request itself arrived over TLS so that a signed iPXE binary
+// chains into a fully TLS-verified boot, rather than dropping back to a
+// bare (and implicitly trusted) relative chain.
+func bootFileHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	args := struct{ Scheme string }{}
+
+	if r.TLS != nil {
+		args.Scheme = fmt.Sprintf("https://%s/", r.Host)
+	}
+
+	if err := bootFileTemplate.Execute(w, args); err != nil {
+		middleware.Logger(ctx).Error(err, "rendering boot file")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// discoveryEnvironment is the synthetic Environment served to a server that
+// hasn't registered yet, so it can run discovery and report in.
+func discoveryEnvironment() metalv1alpha1.Environment {
+	return metalv1alpha1.Environment{
+		ObjectMeta: v1.ObjectMeta{
+			Name: "discovery",
+		},
+		Spec: metalv1alpha1.EnvironmentSpec{
+			Kernel: metalv1alpha1.Kernel{
+				Args: []string{
+					"initrd=initramfs.xz",
+					"page_poison=1",
+					"slab_nomerge",
+					"slub_debug=P",
+					"pti=on",
+					"panic=0",
+					"random.trust_cpu=on",
+					"ima_template=ima-ng",
+					"ima_appraise=fix",
+					"ima_hash=sha512",
+					"ip=dhcp",
+					"console=tty0",
+					"console=ttyS0",
+					"sidero.endpoint=" + fmt.Sprintf("%s:%s", apiEndpoint, server.Port),
+				},
+			},
+		},
+	}
 }
 
-func ipxeHandler(w http.ResponseWriter, r *http.Request) {
+// newAgentClient builds a client.Client the same way whether running
+// in-cluster or against a KUBECONFIG, as used by every handler that needs
+// to look up Server/Environment CRDs.
+func newAgentClient() (client.Client, error) {
 	var (
 		config *rest.Config
 		err    error
@@ -52,28 +105,22 @@ func ipxeHandler(w http.ResponseWriter, r *http.Request) {
 	kubeconfig, ok := os.LookupEnv("KUBECONFIG")
 	if ok {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-		if err != nil {
-			log.Printf("error creating config: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
 	} else {
 		config, err = rest.InClusterConfig()
-		if err != nil {
-			log.Printf("error creating config: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
 	}
 
-	c, err := agentclient.NewClient(config)
 	if err != nil {
-		log.Printf("error creating client: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		return nil, fmt.Errorf("error creating config: %w", err)
 	}
 
-	labels := labelsFromRequest(r)
-
-	log.Printf("UUID: %q", labels["uuid"])
+	return agentclient.NewClient(config)
+}
 
+// resolveServerAndEnvironment is a middleware.Resolver: it looks up the
+// requesting Server by UUID and the Environment it should boot into,
+// falling back to the discovery environment when the server hasn't
+// registered yet.
+func resolveServerAndEnvironment(c client.Client, labels map[string]string) (*metalv1alpha1.Server, *metalv1alpha1.Environment, error) {
 	key := client.ObjectKey{
 		Name: labels["uuid"],
 	}
@@ -84,144 +131,279 @@ func ipxeHandler(w http.ResponseWriter, r *http.Request) {
 		// If we can't find the server then we know that discovery has not been
 		// performed yet.
 		if apierrors.IsNotFound(err) {
-			args := struct {
-				Env metalv1alpha1.Environment
-			}{
-				Env: metalv1alpha1.Environment{
-					ObjectMeta: v1.ObjectMeta{
-						Name: "discovery",
-					},
-					Spec: metalv1alpha1.EnvironmentSpec{
-						Kernel: metalv1alpha1.Kernel{
-							Args: []string{
-								"initrd=initramfs.xz",
-								"page_poison=1",
-								"slab_nomerge",
-								"slub_debug=P",
-								"pti=on",
-								"panic=0",
-								"random.trust_cpu=on",
-								"ima_template=ima-ng",
-								"ima_appraise=fix",
-								"ima_hash=sha512",
-								"ip=dhcp",
-								"console=tty0",
-								"console=ttyS0",
-								"sidero.endpoint=" + fmt.Sprintf("%s:%s", apiEndpoint, server.Port),
-							},
-						},
-					},
-				},
-			}
+			env := discoveryEnvironment()
 
-			var buf bytes.Buffer
+			return nil, &env, nil
+		}
 
-			err = ipxeTemplate.Execute(&buf, args)
-			if err != nil {
-				log.Printf("error rendering template: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, fmt.Errorf("error looking up server: %w", err)
+	}
 
-				return
-			}
+	var env metalv1alpha1.Environment
 
-			if _, err := buf.WriteTo(w); err != nil {
-				log.Printf("error writing to response: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+	if err := determineEnvironment(c, obj, &env); err != nil {
+		return obj, nil, err
+	}
 
-			return
-		}
+	return obj, &env, nil
+}
 
-		log.Printf("error looking up server: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+// serverClassOf returns the name of the ServerClass that owns obj, or ""
+// if it's not owned by one, for use as a metrics label.
+func serverClassOf(obj *metalv1alpha1.Server) string {
+	if obj == nil {
+		return ""
+	}
 
-		return
+	for _, owner := range obj.OwnerReferences {
+		if owner.Kind == "ServerClass" {
+			return owner.Name
+		}
 	}
 
-	var env metalv1alpha1.Environment
+	return ""
+}
 
-	if err := determineEnvironment(c, obj, &env); err != nil {
+func ipxeHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	logger := middleware.Logger(ctx)
+
+	env := middleware.Environment(ctx)
+	srv := middleware.Server(ctx)
+	serverClass := serverClassOf(srv)
+
+	if err := middleware.ResolutionError(ctx); err != nil {
 		if apierrors.IsNotFound(err) {
-			log.Printf("environment not found: %v", err)
+			logger.Info("environment not found", "error", err.Error())
+			middleware.RecordBootAttempt("", serverClass, middleware.OutcomeNotFound)
 			w.WriteHeader(http.StatusNotFound)
 
 			return
 		}
+
+		logger.Error(err, "resolving server/environment")
+		middleware.RecordBootAttempt("", serverClass, middleware.OutcomeError)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
 	}
 
+	outcome := middleware.OutcomeKnown
+	if srv == nil {
+		outcome = middleware.OutcomeDiscovery
+	}
+
+	middleware.RecordBootAttempt(env.Name, serverClass, outcome)
+
 	args := struct {
 		Env metalv1alpha1.Environment
 	}{
-		Env: env,
+		Env: *env,
 	}
 
 	var buf bytes.Buffer
 
-	err = ipxeTemplate.Execute(&buf, args)
-	if err != nil {
-		log.Printf("error rendering template: %v", err)
+	if err := ipxeTemplate.Execute(&buf, args); err != nil {
+		logger.Error(err, "rendering template")
 		w.WriteHeader(http.StatusInternalServerError)
 
 		return
 	}
 
 	if _, err := buf.WriteTo(w); err != nil {
-		log.Printf("error writing to response: %v", err)
+		logger.Error(err, "writing response")
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
-func ServeIPXE(endpoint string) error {
-	apiEndpoint = endpoint
+// environmentAdapter adapts a metalv1alpha1.Environment to bootiso.EnvironmentLike
+// so the bootiso package doesn't need to import the API types package.
+type environmentAdapter struct {
+	env metalv1alpha1.Environment
+}
 
-	mux := http.NewServeMux()
+func (e environmentAdapter) Name() string {
+	return e.env.Name
+}
 
-	mux.Handle("/boot.ipxe", logRequest(http.HandlerFunc(bootFileHandler)))
-	mux.Handle("/ipxe", logRequest(http.HandlerFunc(ipxeHandler)))
-	mux.Handle("/env/", logRequest(http.StripPrefix("/env/", http.FileServer(http.Dir("/var/lib/sidero/env")))))
+func (e environmentAdapter) KernelArgs() []string {
+	return e.env.Spec.Kernel.Args
+}
 
-	log.Println("Listening...")
+// bootISOHandler and bootIMGHandler build hybrid ISO/USB images on demand
+// for hardware that can't PXE boot. They accept the same uuid/mac/serial
+// query params as /ipxe, resolving the requesting server's environment
+// the same way (shared via the request's context, not re-fetched here),
+// then embed that environment's kernel/initrd — resolved via the same
+// staged/mirror-cache/fetch precedence as /env/, so an environment that's
+// only ever been served through the lazy mirror still produces an image
+// — falling back to the discovery environment otherwise.
+func bootISOHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	serveBootImage(ctx, w, r, "sidero-boot.iso")
+}
 
-	return http.ListenAndServe(":8081", mux)
+func bootIMGHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	serveBootImage(ctx, w, r, "sidero-boot.img")
 }
 
-func logRequest(next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("HTTP %s %v %s", r.Method, r.URL, r.RemoteAddr)
-		next.ServeHTTP(w, r)
+func serveBootImage(ctx context.Context, w http.ResponseWriter, r *http.Request, filename string) {
+	logger := middleware.Logger(ctx)
+
+	env := middleware.Environment(ctx)
+	srv := middleware.Server(ctx)
+	serverClass := serverClassOf(srv)
+
+	if err := middleware.ResolutionError(ctx); err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.Info("environment not found", "error", err.Error())
+			middleware.RecordBootAttempt("", serverClass, middleware.OutcomeNotFound)
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		logger.Error(err, "resolving server/environment")
+		middleware.RecordBootAttempt("", serverClass, middleware.OutcomeError)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
 	}
 
-	return http.HandlerFunc(fn)
-}
+	vmlinuzPath, err := resolveEnvFile(env.Name, "vmlinuz")
+	if err != nil {
+		logger.Error(err, "resolving vmlinuz", "env", env.Name)
+		middleware.RecordBootAttempt(env.Name, serverClass, middleware.OutcomeError)
+		w.WriteHeader(http.StatusBadGateway)
 
-func labelsFromRequest(req *http.Request) map[string]string {
-	values := req.URL.Query()
+		return
+	}
 
-	labels := map[string]string{}
+	initrdPath, err := resolveEnvFile(env.Name, "initramfs.xz")
+	if err != nil {
+		logger.Error(err, "resolving initramfs.xz", "env", env.Name)
+		middleware.RecordBootAttempt(env.Name, serverClass, middleware.OutcomeError)
+		w.WriteHeader(http.StatusBadGateway)
 
-	for key := range values {
-		switch strings.ToLower(key) {
-		case "mac":
-			// set mac if and only if it parses
-			if hw, err := parseMAC(values.Get(key)); err == nil {
-				labels[key] = hw.String()
-			}
-		default:
-			// matchers don't use multi-value keys, drop later values
-			labels[key] = values.Get(key)
-		}
+		return
+	}
+
+	dest, err := ioutil.TempFile("", "sidero-boot-*.img")
+	if err != nil {
+		logger.Error(err, "creating temp image file")
+		middleware.RecordBootAttempt(env.Name, serverClass, middleware.OutcomeError)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	defer os.Remove(dest.Name()) //nolint:errcheck
+	defer dest.Close()           //nolint:errcheck
+
+	entries := []bootiso.Entry{{Env: environmentAdapter{env: *env}, VmlinuzPath: vmlinuzPath, InitrdPath: initrdPath}}
+
+	if err := isoBuilder.BuildISO(entries, dest.Name()); err != nil {
+		logger.Error(err, "building boot image")
+		middleware.RecordBootAttempt(env.Name, serverClass, middleware.OutcomeError)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	outcome := middleware.OutcomeKnown
+	if srv == nil {
+		outcome = middleware.OutcomeDiscovery
+	}
+
+	middleware.RecordBootAttempt(env.Name, serverClass, outcome)
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeFile(w, r, dest.Name())
+}
+
+// chain wires the common middleware (request ID, structured logging,
+// label parsing, latency metrics) around handler, optionally resolving
+// the requesting Server/Environment first when resolve is non-nil.
+func chain(name string, c client.Client, resolve middleware.Resolver, handler middleware.ContextHandler) http.Handler {
+	mw := []middleware.Middleware{
+		middleware.WithRequestID,
+		middleware.WithLabels,
+		middleware.WithLogger,
+	}
+
+	if resolve != nil {
+		mw = append(mw, middleware.WithResolution(c, resolve))
 	}
 
-	return labels
+	h := middleware.Chain(middleware.ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		middleware.Instrument(name, handler).ServeHTTPContext(ctx, w, r)
+	}), mw...)
+
+	return &middleware.ContextAdapter{Base: context.Background(), Handler: h}
 }
 
-func parseMAC(s string) (net.HardwareAddr, error) {
-	macAddr, err := net.ParseMAC(s)
+// ServeIPXE serves the iPXE/env-file endpoints per config: always on the
+// plaintext listener, and additionally on a TLS listener when
+// config.TLSListenAddr is set. It blocks until either listener fails.
+func ServeIPXE(endpoint string, config Config) error {
+	apiEndpoint = endpoint
+
+	c, err := newAgentClient()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+
+	mux := http.NewServeMux()
+
+	mux.Handle("/boot.ipxe", chain("boot.ipxe", c, nil, middleware.ContextHandlerFunc(bootFileHandler)))
+	mux.Handle("/ipxe", chain("ipxe", c, resolveServerAndEnvironment, middleware.ContextHandlerFunc(ipxeHandler)))
+	mux.Handle("/boot.iso", chain("boot.iso", c, resolveServerAndEnvironment, middleware.ContextHandlerFunc(bootISOHandler)))
+	mux.Handle("/boot.img", chain("boot.img", c, resolveServerAndEnvironment, middleware.ContextHandlerFunc(bootIMGHandler)))
+	mux.Handle("/env/", chain("env", c, nil, middleware.ContextHandlerFunc(envFileHandler)))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	listenAddr := config.ListenAddr
+	if listenAddr == "" {
+		listenAddr = ":8081"
+	}
+
+	activated, err := socketActivationListeners()
+	if err != nil {
+		return err
+	}
+
+	plainListener, activated, err := takeListener(activated, "tcp", listenAddr)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// buffered so whichever listener fails first doesn't block forever
+	// waiting for a reader.
+	errCh := make(chan error, 2)
+
+	go func() {
+		middleware.Log.Info("listening", "addr", plainListener.Addr().String())
+		errCh <- http.Serve(plainListener, mux)
+	}()
+
+	if config.TLSListenAddr != "" {
+		tlsConfig, err := buildTLSConfig(config)
+		if err != nil {
+			return fmt.Errorf("configuring TLS listener: %w", err)
+		}
+
+		tlsListener, _, err := takeListener(activated, "tcp", config.TLSListenAddr)
+		if err != nil {
+			return err
+		}
+
+		tlsListener = tls.NewListener(tlsListener, tlsConfig)
+
+		go func() {
+			middleware.Log.Info("listening (TLS)", "addr", tlsListener.Addr().String())
+			errCh <- http.Serve(tlsListener, mux)
+		}()
 	}
 
-	return macAddr, err
+	return <-errCh
 }
 
 // determineEnvionment handles which env CRD we'll respect for a given server.
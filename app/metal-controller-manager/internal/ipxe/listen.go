@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipxe
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-systemd/activation"
+)
+
+// socketActivationListeners returns the listeners passed in by systemd
+// socket activation (LISTEN_FDS), in the order the sockets are declared
+// in the unit. It's empty, not an error, when the process wasn't socket
+// activated, so the caller falls back to net.Listen.
+func socketActivationListeners() ([]net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving socket-activated listeners: %w", err)
+	}
+
+	return listeners, nil
+}
+
+// takeListener pops the next socket-activated listener off pool, if any,
+// so a restart handed the same file descriptors keeps the TCP listener
+// alive across the exec. Falling back to net.Listen(network, addr) lets
+// the process still run standalone (e.g. outside systemd, in tests).
+func takeListener(pool []net.Listener, network, addr string) (net.Listener, []net.Listener, error) {
+	if len(pool) > 0 {
+		return pool[0], pool[1:], nil
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, pool, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+
+	return l, pool, nil
+}
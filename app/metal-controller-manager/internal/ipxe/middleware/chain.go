@@ -0,0 +1,18 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package middleware
+
+// Middleware wraps a ContextHandler with additional behavior.
+type Middleware func(ContextHandler) ContextHandler
+
+// Chain applies mw to h in the order given, so the first middleware
+// listed is outermost (runs first on the way in, last on the way out).
+func Chain(h ContextHandler, mw ...Middleware) ContextHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
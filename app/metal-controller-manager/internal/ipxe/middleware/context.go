@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package middleware provides a request-scoped context.Context chain for
+// the iPXE HTTP handlers, modeled on the common ContextAdapter pattern:
+// a http.Handler that seeds a base context, composed with middlewares
+// that attach values (request ID, parsed labels, resolved
+// Server/Environment) for downstream handlers to read instead of each
+// re-deriving them.
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	metalv1alpha1 "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+)
+
+// ContextHandler is http.Handler with the request's context threaded
+// through explicitly, so middleware can attach values to it before it
+// reaches the final handler.
+type ContextHandler interface {
+	ServeHTTPContext(ctx context.Context, w http.ResponseWriter, r *http.Request)
+}
+
+// ContextHandlerFunc adapts a plain function to a ContextHandler.
+type ContextHandlerFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request)
+
+// ServeHTTPContext calls f.
+func (f ContextHandlerFunc) ServeHTTPContext(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	f(ctx, w, r)
+}
+
+// ContextAdapter bridges a ContextHandler into a plain http.Handler that
+// mux.Handle accepts, seeding every request with base.
+type ContextAdapter struct {
+	Base    context.Context
+	Handler ContextHandler
+}
+
+// ServeHTTP implements http.Handler.
+func (ca *ContextAdapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.Handler.ServeHTTPContext(ca.Base, w, r)
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	labelsKey
+	serverKey
+	environmentKey
+	resolveErrKey
+)
+
+// RequestID returns the ID assigned by WithRequestID, or "" if absent.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+
+	return id
+}
+
+// Labels returns the uuid/mac/serial (and any other query params)
+// parsed by WithLabels, or nil if absent.
+func Labels(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsKey).(map[string]string)
+
+	return labels
+}
+
+// Server returns the Server resolved by WithResolution, or nil if the
+// requesting server hasn't registered (or resolution wasn't run).
+func Server(ctx context.Context) *metalv1alpha1.Server {
+	srv, _ := ctx.Value(serverKey).(*metalv1alpha1.Server)
+
+	return srv
+}
+
+// Environment returns the Environment resolved by WithResolution, or
+// nil if resolution failed or wasn't run.
+func Environment(ctx context.Context) *metalv1alpha1.Environment {
+	env, _ := ctx.Value(environmentKey).(*metalv1alpha1.Environment)
+
+	return env
+}
+
+// ResolutionError returns the error WithResolution encountered, if any.
+func ResolutionError(ctx context.Context) error {
+	err, _ := ctx.Value(resolveErrKey).(error)
+
+	return err
+}
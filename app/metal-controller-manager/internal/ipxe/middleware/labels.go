@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithLabels parses the uuid/mac/serial (and any other) query params
+// once per request and stores them in the context, so handlers stop
+// re-parsing r.URL.Query() themselves.
+func WithLabels(next ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTPContext(context.WithValue(ctx, labelsKey, ParseLabels(r)), w, r)
+	})
+}
+
+// ParseLabels extracts matcher labels from a request's query string.
+func ParseLabels(r *http.Request) map[string]string {
+	values := r.URL.Query()
+
+	labels := map[string]string{}
+
+	for key := range values {
+		switch strings.ToLower(key) {
+		case "mac":
+			// set mac if and only if it parses
+			if hw, err := net.ParseMAC(values.Get(key)); err == nil {
+				labels[key] = hw.String()
+			}
+		default:
+			// matchers don't use multi-value keys, drop later values
+			labels[key] = values.Get(key)
+		}
+	}
+
+	return labels
+}
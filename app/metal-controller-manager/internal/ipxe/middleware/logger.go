@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// Log is the package's base structured logger, backed by zap via
+// controller-runtime's logr integration so boot-flow logs carry the
+// same structured fields as the rest of metal-controller-manager and
+// can ship to the same sink.
+var Log logr.Logger = ctrlzap.New()
+
+// WithLogger attaches a per-request logger to the context, in place of
+// the ad-hoc log.Printf calls handlers used to make directly. It must
+// run after WithLabels so the logger carries uuid/mac/serial — the only
+// identifiers a correlated log line from the Talos agent on the booted
+// node could later be matched against.
+func WithLogger(next ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		logger := Log.WithValues("requestID", RequestID(ctx), "method", r.Method, "path", r.URL.Path)
+
+		for k, v := range Labels(ctx) {
+			logger = logger.WithValues(k, v)
+		}
+
+		next.ServeHTTPContext(context.WithValue(ctx, loggerKey, logger), w, r)
+	})
+}
+
+// Logger returns the request-scoped logger attached by WithLogger, or
+// the package base logger if none is attached.
+func Logger(ctx context.Context) logr.Logger {
+	if l, ok := ctx.Value(loggerKey).(logr.Logger); ok {
+		return l
+	}
+
+	return Log
+}
+
+const loggerKey contextKey = -1
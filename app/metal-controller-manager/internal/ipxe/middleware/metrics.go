@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcome labels recorded by RecordBootAttempt.
+const (
+	OutcomeDiscovery = "discovery"
+	OutcomeKnown     = "known"
+	OutcomeNotFound  = "notfound"
+	OutcomeError     = "error"
+)
+
+var (
+	bootAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sidero",
+		Subsystem: "ipxe",
+		Name:      "boot_attempts_total",
+		Help:      "Total boot attempts served, partitioned by environment, server class, and outcome.",
+	}, []string{"env", "serverclass", "outcome"})
+
+	renderLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sidero",
+		Subsystem: "ipxe",
+		Name:      "render_duration_seconds",
+		Help:      "Latency of rendering an iPXE/boot response.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	envBytesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sidero",
+		Subsystem: "ipxe",
+		Name:      "env_bytes_served_total",
+		Help:      "Bytes of environment artifacts (kernel/initrd) served from /env/.",
+	}, []string{"env"})
+
+	mirrorCacheResult = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sidero",
+		Subsystem: "ipxe",
+		Name:      "mirror_cache_result_total",
+		Help:      "Cache hit/miss count for the env mirror backend.",
+	}, []string{"result"})
+)
+
+// RecordBootAttempt records one boot attempt for env/serverClass/outcome.
+func RecordBootAttempt(env, serverClass, outcome string) {
+	bootAttempts.WithLabelValues(env, serverClass, outcome).Inc()
+}
+
+// RecordEnvBytesServed records n bytes of env served for env.
+func RecordEnvBytesServed(env string, n int64) {
+	envBytesServed.WithLabelValues(env).Add(float64(n))
+}
+
+// RecordCacheResult records a mirror cache hit or miss.
+func RecordCacheResult(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	mirrorCacheResult.WithLabelValues(result).Inc()
+}
+
+// Instrument wraps next, recording its latency in renderLatency under
+// the given handler label.
+func Instrument(handler string, next ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		next.ServeHTTPContext(ctx, w, r)
+
+		renderLatency.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// WithRequestID assigns each request a short random ID, echoed back as
+// X-Request-Id and attached to the request's log lines by WithLogger, so
+// all log lines of one request can be correlated with each other.
+func WithRequestID(next ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		id, err := newRequestID()
+		if err != nil {
+			id = "unknown"
+		}
+
+		w.Header().Set("X-Request-Id", id)
+
+		next.ServeHTTPContext(context.WithValue(ctx, requestIDKey, id), w, r)
+	})
+}
+
+func newRequestID() (string, error) {
+	buf := make([]byte, 8)
+
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
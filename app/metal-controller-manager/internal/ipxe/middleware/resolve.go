@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metalv1alpha1 "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+)
+
+// Resolver looks up the Server and Environment CRDs for a request's
+// parsed labels (e.g. by UUID), falling back as ipxeHandler's discovery
+// flow does when the server hasn't registered yet.
+type Resolver func(c client.Client, labels map[string]string) (*metalv1alpha1.Server, *metalv1alpha1.Environment, error)
+
+// WithResolution resolves the requesting Server/Environment once per
+// request via resolve, storing both (or the resulting error) in the
+// context so ipxeHandler and the ISO handlers read the result from the
+// context instead of each performing their own lookups.
+//
+// srv/env are attached whenever resolve returns them, even alongside an
+// error — resolve can find the Server but fail to determine its
+// Environment, and handlers need srv (e.g. for the serverclass metrics
+// label) in that case just as much as when resolution fully succeeds.
+func WithResolution(c client.Client, resolve Resolver) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			srv, env, err := resolve(c, Labels(ctx))
+
+			if srv != nil {
+				ctx = context.WithValue(ctx, serverKey, srv)
+			}
+
+			if env != nil {
+				ctx = context.WithValue(ctx, environmentKey, env)
+			}
+
+			if err != nil {
+				ctx = context.WithValue(ctx, resolveErrKey, err)
+			}
+
+			next.ServeHTTPContext(ctx, w, r)
+		})
+	}
+}
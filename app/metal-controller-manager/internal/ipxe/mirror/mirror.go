@@ -0,0 +1,281 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package mirror lazily fetches environment artifacts (kernel, initrd)
+// from an upstream mirror when they're missing from the local cache,
+// verifying each against a declared digest incrementally as it streams
+// the fetch to both the cache and (for the caller that triggered it) a
+// live client, rather than fully landing it on disk before anything is
+// served.
+package mirror
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrDigestMismatch is returned (wrapped) by Fetch when a fetched
+// artifact's digest doesn't match spec.Digest. If the error's teed
+// return value is true, the (now known-bad) bytes have already been
+// written to the caller's w before the mismatch could be detected —
+// digests can only be verified once the full body has streamed through
+// the hasher — so the caller should abort its connection outright
+// rather than let a client believe it received a complete, valid file.
+var ErrDigestMismatch = errors.New("mirror: digest mismatch")
+
+// BasicAuth carries upstream HTTP basic-auth credentials for a Spec.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Spec describes a single artifact to fetch from an upstream mirror.
+type Spec struct {
+	// CacheKey locates the artifact inside the backend's cache dir once
+	// fetched, e.g. "<env>/vmlinuz". Pre-existing files at this path are
+	// treated as already cached, digest or not.
+	CacheKey string
+
+	// URL is the upstream location to fetch the artifact from.
+	URL string
+
+	// Digest is the expected sha512 hex digest. Fetched content that
+	// doesn't match is discarded rather than promoted into the cache.
+	Digest string
+
+	// BasicAuth and BearerToken optionally authenticate the upstream
+	// request; set at most one.
+	BasicAuth   *BasicAuth
+	BearerToken string
+}
+
+// Config controls the on-disk cache a Backend maintains.
+type Config struct {
+	// CacheDir is the root artifacts are cached under, keyed by each
+	// Spec's CacheKey.
+	CacheDir string
+
+	// QuotaBytes caps the cache's total size. Once a fetch pushes the
+	// cache over quota, the least-recently-used entries (by mtime) are
+	// evicted until it's back under.
+	QuotaBytes int64
+}
+
+// Backend lazily fetches environment artifacts from an upstream mirror,
+// coalescing concurrent fetches of the same artifact via single-flight
+// so multiple iPXE clients booting the same environment at once trigger
+// only one upstream request.
+type Backend struct {
+	config Config
+	group  singleflight.Group
+}
+
+// NewBackend returns a Backend caching artifacts under config.CacheDir.
+func NewBackend(config Config) *Backend {
+	return &Backend{config: config}
+}
+
+// Open returns the local cache path for spec, fetching it from spec.URL
+// first if it isn't already cached locally.
+func (b *Backend) Open(spec Spec) (string, error) {
+	path, _, err := b.Fetch(spec, io.Discard)
+
+	return path, err
+}
+
+// Fetch resolves spec to a local cache path the same as Open, but when
+// upstream must be consulted, tees the download to w as it streams to
+// disk and through the digest hasher, instead of only handing back a
+// path once the whole (possibly multi-hundred-MB) artifact has landed
+// and verified. Use Open instead when no live client is waiting on the
+// bytes (e.g. staging a file for the boot image builder).
+//
+// teed reports whether w actually received anything: concurrent Fetch
+// calls for the same spec are coalesced via singleflight, and only the
+// call that actually triggers the fetch has its w written to — a
+// caller for which teed is false should serve the returned path itself
+// (e.g. via http.ServeFile) the ordinary way.
+func (b *Backend) Fetch(spec Spec, w io.Writer) (path string, teed bool, err error) {
+	cachePath := filepath.Join(b.config.CacheDir, filepath.FromSlash(spec.CacheKey))
+
+	if _, err := os.Stat(cachePath); err == nil {
+		touch(cachePath)
+
+		return cachePath, false, nil
+	}
+
+	if spec.URL == "" {
+		return "", false, fmt.Errorf("mirror: %s not cached and no upstream URL configured", spec.CacheKey)
+	}
+
+	rec := &countingWriter{w: w}
+
+	if _, err, _ := b.group.Do(spec.CacheKey, func() (interface{}, error) {
+		return nil, b.fetch(spec, cachePath, rec)
+	}); err != nil {
+		return "", rec.n > 0, err
+	}
+
+	touch(cachePath)
+
+	// Eviction runs after the fetch (and the tee to w, if any) has fully
+	// and successfully completed, so a failure here never leaves an
+	// already-served response looking like it failed — it's purely
+	// housekeeping that's safe to retry on the next fetch.
+	_ = b.evict()
+
+	return cachePath, rec.n > 0, nil
+}
+
+// countingWriter wraps an io.Writer, tracking whether anything was ever
+// written to it — used by Fetch to tell whether a given call's w was
+// the one a coalesced fetch actually wrote to.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// fetch downloads spec.URL into a temp file alongside cachePath, teeing
+// it to tee as it streams, and verifies its sha512 digest against
+// spec.Digest before promoting the temp file into place with an atomic
+// rename.
+func (b *Backend) fetch(spec Spec, cachePath string, tee io.Writer) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		return fmt.Errorf("creating cache dir: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, spec.URL, nil)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	switch {
+	case spec.BasicAuth != nil:
+		req.SetBasicAuth(spec.BasicAuth.Username, spec.BasicAuth.Password)
+	case spec.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+spec.BearerToken)
+	}
+
+	// http.DefaultTransport honors HTTP_PROXY/HTTPS_PROXY/NO_PROXY via
+	// http.ProxyFromEnvironment, so air-gapped clusters pointed at an
+	// internal mirror through a proxy work without extra wiring here.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", spec.URL, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: unexpected status %s", spec.URL, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".mirror-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	defer tmp.Close()           //nolint:errcheck
+
+	hasher := sha512.New()
+
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher, tee), resp.Body); err != nil {
+		return fmt.Errorf("streaming %s to disk: %w", spec.URL, err)
+	}
+
+	if digest := hex.EncodeToString(hasher.Sum(nil)); spec.Digest != "" && digest != spec.Digest {
+		return fmt.Errorf("%w for %s: got %s, want %s", ErrDigestMismatch, spec.URL, digest, spec.Digest)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return fmt.Errorf("promoting %s into cache: %w", spec.URL, err)
+	}
+
+	return nil
+}
+
+// evict walks the cache dir and removes the least-recently-used files
+// (oldest mtime first) until the total size is back under QuotaBytes.
+func (b *Backend) evict() error {
+	if b.config.QuotaBytes <= 0 {
+		return nil
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var (
+		entries []entry
+		total   int64
+	)
+
+	err := filepath.Walk(b.config.CacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if total <= b.config.QuotaBytes {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+
+	for _, e := range entries {
+		if total <= b.config.QuotaBytes {
+			break
+		}
+
+		if err := os.Remove(e.path); err != nil {
+			return err
+		}
+
+		total -= e.size
+	}
+
+	return nil
+}
+
+// touch bumps path's mtime so evict's LRU ordering reflects the most
+// recent access, not just the fetch time.
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
@@ -0,0 +1,222 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipxe
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/talos-systems/sidero/app/metal-controller-manager/internal/ipxe/middleware"
+)
+
+// Config configures the listeners ServeIPXE binds: the plaintext iPXE
+// endpoint and an optional TLS listener for signed iPXE binaries that
+// verify the chain via iPXE's --trust flag.
+type Config struct {
+	// ListenAddr is the plaintext address to listen on. Defaults to
+	// ":8081" when empty.
+	ListenAddr string
+
+	// TLSListenAddr is the address the TLS listener binds. Leave empty
+	// to disable TLS entirely.
+	TLSListenAddr string
+
+	// TLSCertFile and TLSKeyFile name a cert/key pair to serve, reloaded
+	// from disk whenever they change so cert-manager-issued certs rotate
+	// without a restart. When both are empty and TLSListenAddr is set, a
+	// self-signed cert is generated at startup; its fingerprint is
+	// published via TLSFingerprint for use with iPXE's --trust flag.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCAFile, if set, requires and verifies client certificates
+	// signed by this CA on the TLS listener (mTLS).
+	ClientCAFile string
+}
+
+// TLSFingerprint is the SHA-256 fingerprint (hex-encoded) of the
+// self-signed certificate generated when Config doesn't provide a
+// TLSCertFile/TLSKeyFile pair. It's unset when a caller-provided cert is
+// in use, since operators already know that cert's fingerprint.
+var TLSFingerprint string
+
+// buildTLSConfig assembles the *tls.Config for the TLS listener,
+// preferring a reloadable cert/key pair from disk and falling back to a
+// generated self-signed cert.
+func buildTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch {
+	case config.TLSCertFile != "" && config.TLSKeyFile != "":
+		reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS cert/key: %w", err)
+		}
+
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	default:
+		cert, fingerprint, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("generating self-signed cert: %w", err)
+		}
+
+		TLSFingerprint = fingerprint
+
+		tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+
+	if config.ClientCAFile != "" {
+		pool := x509.NewCertPool()
+
+		pem, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA file: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", config.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader implements tls.Config.GetCertificate, reloading the
+// cert/key pair from disk whenever the cert file's mtime changes so
+// cert-manager-issued certs rotate without restarting the process.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu            sync.RWMutex
+	cert          *tls.Certificate
+	loadedModTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	go r.watch()
+
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("stat'ing cert file: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading keypair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.loadedModTime = info.ModTime()
+	r.mu.Unlock()
+
+	return nil
+}
+
+// watch stat-polls the cert file for changes, reloading on every mtime
+// change. Polling avoids pulling in a filesystem watcher for what's an
+// infrequent event; a cert rotation doesn't need to apply faster than
+// this interval.
+func (r *certReloader) watch() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(r.certFile)
+		if err != nil {
+			middleware.Log.Error(err, "stat'ing TLS cert for reload", "certFile", r.certFile)
+
+			continue
+		}
+
+		r.mu.RLock()
+		changed := !info.ModTime().Equal(r.loadedModTime)
+		r.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			middleware.Log.Error(err, "reloading TLS cert", "certFile", r.certFile)
+
+			continue
+		}
+
+		middleware.Log.Info("reloaded TLS cert", "certFile", r.certFile)
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// generateSelfSignedCert produces an ephemeral self-signed cert for the
+// TLS listener when no cert/key are configured, along with its SHA-256
+// fingerprint so operators can pin it with iPXE's --trust flag.
+func generateSelfSignedCert() (tls.Certificate, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generating serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "sidero-ipxe"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("creating certificate: %w", err)
+	}
+
+	fingerprint := sha256.Sum256(der)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, fmt.Sprintf("%x", fingerprint), nil
+}